@@ -0,0 +1,247 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package promql
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/prometheus/model/histogram"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/util/teststorage"
+)
+
+// SeriesEncoding selects the chunk encoding used when generating synthetic
+// series for a BenchLoader.
+type SeriesEncoding int
+
+const (
+	// EncFloat generates plain float samples.
+	EncFloat SeriesEncoding = iota
+	// EncHistogram generates native histogram samples.
+	EncHistogram
+)
+
+// BenchLoaderOpts configure the synthetic series set produced by a
+// BenchLoader.
+type BenchLoaderOpts struct {
+	// NumSeries and NumSamples set the size of the generated matrix.
+	NumSeries  int
+	NumSamples int
+
+	// LabelsPerSeries adds this many extra labels to each series, on top
+	// of __name__, series_id and gen, to control label cardinality.
+	LabelsPerSeries int
+
+	// Step is the spacing between samples. Defaults to 15s.
+	Step time.Duration
+
+	// Encoding selects float or histogram samples.
+	Encoding SeriesEncoding
+
+	// Churn is the fraction, in [0, 1], of series whose label set is
+	// replaced every ChurnEvery samples. A zero ChurnEvery disables churn.
+	Churn      float64
+	ChurnEvery int
+
+	// Jitter randomizes each sample's timestamp by up to +/- Jitter.
+	Jitter time.Duration
+
+	// Seed makes generation reproducible. Zero uses a fixed default seed.
+	Seed int64
+}
+
+// BenchLoader programmatically materializes a large, synthetic series set
+// directly into a test storage, without going through the `load` DSL used
+// by LazyLoader. It exists to give engine benchmarks a standard, scalable
+// series set to query.
+type BenchLoader struct {
+	opts BenchLoaderOpts
+
+	storage storage.Storage
+
+	ctx       context.Context
+	cancelCtx context.CancelFunc
+}
+
+// NewBenchLoader creates a BenchLoader and eagerly generates its series
+// according to opts.
+func NewBenchLoader(opts BenchLoaderOpts) (*BenchLoader, error) {
+	if opts.NumSeries <= 0 || opts.NumSamples <= 0 {
+		return nil, fmt.Errorf("BenchLoaderOpts.NumSeries and NumSamples must be positive")
+	}
+	if opts.Step <= 0 {
+		opts.Step = 15 * time.Second
+	}
+	// Jitter must stay under half the step, or two consecutive
+	// samples for the same series can land at an equal or decreasing
+	// timestamp, which the appender rejects as out-of-order.
+	if 2*opts.Jitter >= opts.Step {
+		return nil, fmt.Errorf("BenchLoaderOpts.Jitter (%s) must be less than half of Step (%s)", opts.Jitter, opts.Step)
+	}
+
+	bl := &BenchLoader{opts: opts}
+	bl.ctx, bl.cancelCtx = context.WithCancel(context.Background())
+	bl.storage = teststorage.New(bl)
+
+	if err := bl.generate(); err != nil {
+		bl.Close()
+		return nil, err
+	}
+	return bl, nil
+}
+
+func (bl *BenchLoader) generate() error {
+	rnd := rand.New(rand.NewSource(bl.seed()))
+	app := bl.storage.Appender(bl.ctx)
+
+	series := make([]labels.Labels, bl.opts.NumSeries)
+	gens := make([]int, bl.opts.NumSeries)
+	for i := range series {
+		series[i] = bl.seriesLabels(i, gens[i])
+	}
+
+	for sampleIdx := 0; sampleIdx < bl.opts.NumSamples; sampleIdx++ {
+		if bl.opts.ChurnEvery > 0 && sampleIdx > 0 && sampleIdx%bl.opts.ChurnEvery == 0 {
+			for i := range series {
+				if rnd.Float64() < bl.opts.Churn {
+					gens[i]++
+					series[i] = bl.seriesLabels(i, gens[i])
+				}
+			}
+		}
+
+		ts := testStartTime.Add(time.Duration(sampleIdx) * bl.opts.Step)
+		if bl.opts.Jitter > 0 {
+			ts = ts.Add(time.Duration(rnd.Int63n(int64(bl.opts.Jitter)*2)) - bl.opts.Jitter)
+		}
+		tsMilli := ts.UnixNano() / int64(time.Millisecond)
+
+		for i, lset := range series {
+			var err error
+			switch bl.opts.Encoding {
+			case EncHistogram:
+				_, err = app.AppendHistogram(0, lset, tsMilli, nil, generateFloatHistogram(sampleIdx))
+			default:
+				_, err = app.Append(0, lset, tsMilli, rnd.Float64()*float64(i+1))
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return app.Commit()
+}
+
+func (bl *BenchLoader) seed() int64 {
+	if bl.opts.Seed != 0 {
+		return bl.opts.Seed
+	}
+	return 42
+}
+
+// seriesLabels builds the label set for series i at churn generation gen.
+// Bumping gen (on a churn event) changes the "gen" label, so a churned
+// series is a genuinely new series identity in the TSDB rather than a
+// byte-for-byte repeat of the one it replaces.
+func (bl *BenchLoader) seriesLabels(i, gen int) labels.Labels {
+	b := labels.NewBuilder(labels.EmptyLabels())
+	b.Set("__name__", "bench_metric")
+	b.Set("series_id", strconv.Itoa(i))
+	b.Set("gen", strconv.Itoa(gen))
+	for j := 0; j < bl.opts.LabelsPerSeries; j++ {
+		b.Set(fmt.Sprintf("label_%d", j), fmt.Sprintf("value_%d", (i+j+gen)%97))
+	}
+	return b.Labels()
+}
+
+// generateFloatHistogram returns a single-bucket FloatHistogram whose Count
+// equals the sum of its bucket counts (here, ZeroCount plus the one
+// positive bucket), so it is internally consistent.
+func generateFloatHistogram(sampleIdx int) *histogram.FloatHistogram {
+	v := float64(sampleIdx + 1)
+	return &histogram.FloatHistogram{
+		Schema:        1,
+		ZeroThreshold: 0.001,
+		Count:         v,
+		Sum:           v,
+		PositiveSpans: []histogram.Span{
+			{Offset: 0, Length: 1},
+		},
+		PositiveBuckets: []float64{v},
+	}
+}
+
+// Queryable returns a storage.Queryable over the generated series.
+func (bl *BenchLoader) Queryable() storage.Queryable {
+	return bl.storage
+}
+
+// Storage returns the BenchLoader's underlying storage.
+func (bl *BenchLoader) Storage() storage.Storage {
+	return bl.storage
+}
+
+// Context returns the BenchLoader's context.
+func (bl *BenchLoader) Context() context.Context {
+	return bl.ctx
+}
+
+// Close releases resources held by the BenchLoader.
+func (bl *BenchLoader) Close() error {
+	bl.cancelCtx()
+	return bl.storage.Close()
+}
+
+// Helper implements testutil.T, as required by teststorage.New. There is no
+// real *testing.T available at that call site, so this is a no-op.
+func (bl *BenchLoader) Helper() {}
+
+// Fatalf implements testutil.T, as required by teststorage.New. It cancels
+// the BenchLoader's context and panics, since there is no *testing.T to
+// fail through at that call site.
+func (bl *BenchLoader) Fatalf(format string, args ...interface{}) {
+	if bl.cancelCtx != nil {
+		bl.cancelCtx()
+	}
+	panic(fmt.Sprintf(format, args...))
+}
+
+// InstantQuery runs qs as an instant query at ts against eng, using the
+// generated series as input.
+func (bl *BenchLoader) InstantQuery(eng *Engine, qs string, ts time.Time) (*Result, error) {
+	q, err := eng.NewInstantQuery(bl.ctx, bl.storage, nil, qs, ts)
+	if err != nil {
+		return nil, err
+	}
+	defer q.Close()
+	res := q.Exec(bl.ctx)
+	return res, res.Err
+}
+
+// RangeQuery runs qs as a range query against eng, using the generated
+// series as input.
+func (bl *BenchLoader) RangeQuery(eng *Engine, qs string, start, end time.Time, step time.Duration) (*Result, error) {
+	q, err := eng.NewRangeQuery(bl.ctx, bl.storage, nil, qs, start, end, step)
+	if err != nil {
+		return nil, err
+	}
+	defer q.Close()
+	res := q.Exec(bl.ctx)
+	return res, res.Err
+}
@@ -0,0 +1,179 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package promql
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+// TestBenchLoader_Churn guards against churn being a no-op: with Churn set
+// to 1 and ChurnEvery set to every sample, each base series must have
+// produced more than one distinct series identity in storage.
+func TestBenchLoader_Churn(t *testing.T) {
+	bl, err := NewBenchLoader(BenchLoaderOpts{
+		NumSeries:  2,
+		NumSamples: 4,
+		Step:       15 * time.Second,
+		Churn:      1,
+		ChurnEvery: 1,
+	})
+	require.NoError(t, err)
+	defer bl.Close()
+
+	querier, err := bl.Queryable().Querier(math.MinInt64, math.MaxInt64)
+	require.NoError(t, err)
+	m, err := labels.NewMatcher(labels.MatchEqual, "__name__", "bench_metric")
+	require.NoError(t, err)
+
+	ss := querier.Select(bl.Context(), false, nil, m)
+	count := 0
+	for ss.Next() {
+		count++
+	}
+	require.NoError(t, ss.Err())
+	require.Greater(t, count, bl.opts.NumSeries, "churn should have produced distinct series identities")
+}
+
+// TestBenchLoader_Jitter exercises non-zero Jitter, including the boundary
+// at which it must be rejected: a Jitter of at least half the Step can
+// make consecutive samples for a series land at an equal or decreasing
+// timestamp, which the appender would reject as out-of-order.
+func TestBenchLoader_Jitter(t *testing.T) {
+	t.Run("within bounds generates successfully", func(t *testing.T) {
+		bl, err := NewBenchLoader(BenchLoaderOpts{
+			NumSeries:  5,
+			NumSamples: 50,
+			Step:       15 * time.Second,
+			Jitter:     5 * time.Second,
+		})
+		require.NoError(t, err)
+		bl.Close()
+	})
+
+	t.Run("at or above half the step is rejected", func(t *testing.T) {
+		_, err := NewBenchLoader(BenchLoaderOpts{
+			NumSeries:  5,
+			NumSamples: 50,
+			Step:       15 * time.Second,
+			Jitter:     8 * time.Second,
+		})
+		require.Error(t, err)
+	})
+}
+
+func newBenchEngine() *Engine {
+	return NewEngine(EngineOpts{
+		MaxSamples: 50000000,
+		Timeout:    time.Minute,
+	})
+}
+
+func BenchmarkEngine_SelectorHeavy(b *testing.B) {
+	bl, err := NewBenchLoader(BenchLoaderOpts{
+		NumSeries:       2000,
+		NumSamples:      200,
+		LabelsPerSeries: 4,
+		Step:            15 * time.Second,
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer bl.Close()
+
+	eng := newBenchEngine()
+	ts := testStartTime.Add(100 * 15 * time.Second)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := bl.InstantQuery(eng, `bench_metric{label_0="value_1"}`, ts); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkEngine_AggregationHeavy(b *testing.B) {
+	bl, err := NewBenchLoader(BenchLoaderOpts{
+		NumSeries:       5000,
+		NumSamples:      200,
+		LabelsPerSeries: 4,
+		Step:            15 * time.Second,
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer bl.Close()
+
+	eng := newBenchEngine()
+	ts := testStartTime.Add(100 * 15 * time.Second)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := bl.InstantQuery(eng, `sum by (label_0) (bench_metric)`, ts); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkEngine_HistogramSelectorHeavy(b *testing.B) {
+	bl, err := NewBenchLoader(BenchLoaderOpts{
+		NumSeries:       2000,
+		NumSamples:      200,
+		LabelsPerSeries: 4,
+		Step:            15 * time.Second,
+		Encoding:        EncHistogram,
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer bl.Close()
+
+	eng := newBenchEngine()
+	ts := testStartTime.Add(100 * 15 * time.Second)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := bl.InstantQuery(eng, `bench_metric{label_0="value_1"}`, ts); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkEngine_RateOverLongRange(b *testing.B) {
+	bl, err := NewBenchLoader(BenchLoaderOpts{
+		NumSeries:       500,
+		NumSamples:      2000,
+		LabelsPerSeries: 4,
+		Step:            15 * time.Second,
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer bl.Close()
+
+	eng := newBenchEngine()
+	end := testStartTime.Add(2000 * 15 * time.Second)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := bl.InstantQuery(eng, `rate(bench_metric[1h])`, end); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -14,12 +14,16 @@
 package promql
 
 import (
+	"context"
+	"fmt"
 	"math"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/require"
 
+	"github.com/prometheus/prometheus/model/exemplar"
 	"github.com/prometheus/prometheus/model/labels"
 	"github.com/prometheus/prometheus/tsdb/chunkenc"
 )
@@ -107,6 +111,56 @@ func TestLazyLoader_WithSamplesTill(t *testing.T) {
 				},
 			},
 		},
+		{
+			loadString: `
+				load 10s
+					metric1{foo="bar"} 1+1x10 # exemplar{trace_id="abc"} 1 @ 10000
+			`,
+			testCases: []testCase{
+				{
+					ts: time.Unix(40, 0),
+					series: []Series{
+						{
+							Metric: labels.FromStrings("__name__", "metric1", "foo", "bar"),
+							Floats: []FPoint{
+								{0, 1}, {10000, 2}, {20000, 3}, {30000, 4}, {40000, 5},
+							},
+							Exemplars: []exemplar.Exemplar{
+								{Labels: labels.FromStrings("trace_id", "abc"), Value: 1, Ts: 10000, HasTs: true},
+							},
+						},
+					},
+				},
+			},
+		},
+		{ // An exemplar whose label name+value combined length is exactly
+			// the 128-rune OpenMetrics cap must be accepted.
+			loadString: fmt.Sprintf(`
+				load 10s
+					metric1 1+1x10 # exemplar{trace_id="%s"} 1 @ 10000
+			`, strings.Repeat("a", 128-len("trace_id"))),
+			testCases: []testCase{
+				{
+					ts: time.Unix(10, 0),
+					series: []Series{
+						{
+							Metric: labels.FromStrings("__name__", "metric1"),
+							Floats: []FPoint{
+								{0, 1}, {10000, 2},
+							},
+							Exemplars: []exemplar.Exemplar{
+								{
+									Labels: labels.FromStrings("trace_id", strings.Repeat("a", 128-len("trace_id"))),
+									Value:  1,
+									Ts:     10000,
+									HasTs:  true,
+								},
+							},
+						},
+					},
+				},
+			},
+		},
 	}
 
 	for _, c := range cases {
@@ -150,9 +204,77 @@ func TestLazyLoader_WithSamplesTill(t *testing.T) {
 					}
 					require.NoError(t, it.Err())
 
+					// Pull in any exemplars attached to the series.
+					eq, err := suite.Storage().ExemplarQuerier(suite.Context())
+					require.NoError(t, err)
+					exs, err := eq.Select(math.MinInt64, math.MaxInt64, matchers)
+					require.NoError(t, err)
+					for _, er := range exs {
+						got.Exemplars = append(got.Exemplars, er.Exemplars...)
+					}
+					// Exemplar storage is opt-in on the underlying TSDB. Assert
+					// directly on the querier result (not just via the Series
+					// equality check below) so a disabled/misconfigured
+					// exemplar store fails loudly instead of this sub-case
+					// silently comparing two empty slices.
+					if len(s.Exemplars) > 0 {
+						require.NotEmpty(t, got.Exemplars, "expected exemplars to have been persisted and queryable; is exemplar storage enabled on the test storage?")
+					}
+
 					require.Equal(t, s, got)
 				}
 			})
 		}
 	}
 }
+
+// TestLazyLoader_ExemplarLabelLengthCap exercises the OpenMetrics cap on
+// the combined length of an exemplar's label names and values: exactly 128
+// runes is allowed (covered in TestLazyLoader_WithSamplesTill), and 129+
+// runes must be rejected at parse time with a clear error.
+func TestLazyLoader_ExemplarLabelLengthCap(t *testing.T) {
+	loadString := fmt.Sprintf(`
+		load 10s
+			metric1 1+1x10 # exemplar{trace_id="%s"} 1 @ 10000
+	`, strings.Repeat("a", 129-len("trace_id")))
+
+	_, err := NewLazyLoader(loadString, LazyLoaderOpts{})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "exceeds the OpenMetrics cap")
+}
+
+func TestLazyLoader_WithSamplesTillContext(t *testing.T) {
+	loadString := `
+		load 10s
+			metric1 1+1x100
+	`
+
+	t.Run("cancelled context is returned to the callback", func(t *testing.T) {
+		suite, err := NewLazyLoader(loadString, LazyLoaderOpts{})
+		require.NoError(t, err)
+		defer suite.Close()
+
+		ctx, cancel := context.WithCancel(suite.Context())
+		cancel()
+
+		called := false
+		suite.WithSamplesTillContext(ctx, time.Unix(1000, 0), func(err error) {
+			called = true
+			require.ErrorIs(t, err, context.Canceled)
+		})
+		require.True(t, called)
+	})
+
+	t.Run("MaxAppendDuration bounds WithSamplesTill", func(t *testing.T) {
+		suite, err := NewLazyLoader(loadString, LazyLoaderOpts{MaxAppendDuration: time.Nanosecond})
+		require.NoError(t, err)
+		defer suite.Close()
+
+		called := false
+		suite.WithSamplesTill(time.Unix(1000, 0), func(err error) {
+			called = true
+			require.ErrorIs(t, err, context.DeadlineExceeded)
+		})
+		require.True(t, called)
+	})
+}
@@ -0,0 +1,40 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package promql
+
+import (
+	"github.com/prometheus/prometheus/model/exemplar"
+	"github.com/prometheus/prometheus/model/histogram"
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+// Series is a stream of data points belonging to a metric.
+type Series struct {
+	Metric     labels.Labels
+	Floats     []FPoint
+	Histograms []HPoint
+	Exemplars  []exemplar.Exemplar
+}
+
+// FPoint represents a single float data point for a given timestamp.
+type FPoint struct {
+	T int64
+	F float64
+}
+
+// HPoint represents a single histogram data point for a given timestamp.
+type HPoint struct {
+	T int64
+	H *histogram.FloatHistogram
+}